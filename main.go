@@ -6,24 +6,61 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/smizoe/get_imgs/modules"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var (
-		outputDir   string
-		maxRoutines int
-		query       string
-		accKey      string
+		outputDir     string
+		maxRoutines   int
+		query         string
+		providerNames string
+		pages         int
+		bingKey       string
+		openSearchUrl string
+		openSearchKey string
+		htmlUrl       string
+		queryTimeout  time.Duration
+		getTimeout    time.Duration
+		progressMode  string
+		perFileBars   bool
+		dedup         bool
+		force         bool
+		globalRPS     float64
+		perHostRPS    float64
+		perHostLimit  int
+		maxRetries    int
+		minBytes      int64
 	)
 
 	flag.StringVar(&outputDir, "output-dir", os.TempDir(), "Specifies the directory to store images.")
 	flag.IntVar(&maxRoutines, "max-routines", 4, "Specifies the max number of go routines to be spawned to download images.")
 	flag.StringVar(&query, "query", "", "Specifies the query string to be searched.")
-	flag.StringVar(&accKey, "access-key", "", "Specifies the key to query against Bing API.")
+	flag.StringVar(&providerNames, "provider", "bing", "Specifies a comma-separated list of SearchProviders to query (bing, opensearch, html).")
+	flag.IntVar(&pages, "pages", 1, "Specifies the number of pages to fetch from each provider.")
+	flag.StringVar(&bingKey, "access-key", "", "Specifies the key to query against Bing API.")
+	flag.StringVar(&openSearchUrl, "opensearch-url", "", "Specifies the URL template (with {query} and {skip} placeholders) for the opensearch provider.")
+	flag.StringVar(&openSearchKey, "opensearch-key", "", "Specifies the API key for the opensearch provider.")
+	flag.StringVar(&htmlUrl, "html-url", "", "Specifies the URL template (with {query} and {skip} placeholders) for the html provider.")
+	flag.DurationVar(&queryTimeout, "query-timeout", 30*time.Second, "Specifies the timeout for a single search provider request.")
+	flag.DurationVar(&getTimeout, "get-timeout", time.Minute, "Specifies the timeout for a single image download.")
+	flag.StringVar(&progressMode, "progress", "none", "Specifies how progress is reported: none, json, or bar.")
+	flag.BoolVar(&perFileBars, "progress-per-file", false, "When --progress=bar, also render a byte-progress bar per in-flight download.")
+	flag.BoolVar(&dedup, "dedup", false, "Skip (hard-linking instead) images whose content already exists in output-dir, tracked via manifest.json.")
+	flag.BoolVar(&force, "force", false, "With --dedup, write out every image even if its content digest is already in manifest.json.")
+	flag.Float64Var(&globalRPS, "global-rps", 0, "Specifies the max requests per second across every host (0 = unlimited).")
+	flag.Float64Var(&perHostRPS, "per-host-rps", 0, "Specifies the max requests per second to any single host (0 = unlimited).")
+	flag.IntVar(&perHostLimit, "per-host-concurrency", 0, "Specifies the max concurrent in-flight requests to any single host (0 = unlimited).")
+	flag.IntVar(&maxRetries, "max-retries", 2, "Specifies the number of times a failed (network error or 429/5xx) download is retried.")
+	flag.Int64Var(&minBytes, "min-bytes", 0, "Rejects a downloaded image whose reported size is smaller than this many bytes (0 = no minimum).")
 
 	flag.Parse()
 	logInfo := log.New(os.Stderr, "I: ", log.Flags())
@@ -34,22 +71,116 @@ func main() {
 		os.Exit(1)
 	}
 
+	providerConfigs := map[string]modules.ProviderConfig{
+		"bing":       {Auth: modules.AuthConfig{BasicUser: bingKey, BasicPass: bingKey}, QueryTimeout: queryTimeout},
+		"opensearch": {Auth: modules.AuthConfig{APIKey: openSearchKey}, URLTemplate: openSearchUrl, QueryTimeout: queryTimeout},
+		"html":       {URLTemplate: htmlUrl, QueryTimeout: queryTimeout},
+	}
+
+	var providers []modules.SearchProvider
+	for _, name := range strings.Split(providerNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		provider, err := modules.NewSearchProvider(name, providerConfigs[name])
+		if err != nil {
+			logError.Print(err)
+			os.Exit(1)
+		}
+		providers = append(providers, provider)
+	}
+
+	var reporter modules.Reporter = modules.NoopReporter{}
+	var barReporter *modules.BarReporter
+	switch progressMode {
+	case "none":
+	case "json":
+		reporter = modules.NewJSONReporter(os.Stdout)
+	case "bar":
+		var err error
+		barReporter, err = modules.NewBarReporter(perFileBars)
+		if err != nil {
+			logError.Print(err)
+			os.Exit(1)
+		}
+		reporter = barReporter
+	default:
+		logError.Print("unknown --progress mode: ", progressMode)
+		os.Exit(1)
+	}
+
+	var manifest *modules.Manifest
+	if dedup {
+		var err error
+		manifest, err = modules.LoadManifest(outputDir)
+		if err != nil {
+			logError.Print(err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logInfo.Print("Received signal ", sig, ", cancelling...")
+		cancel()
+	}()
+
 	opStatus := make(chan *modules.OperationReply)
 	chanPair := make(chan *modules.ResultPair)
 
-	req := modules.NewRequester(opStatus, query, accKey, chanPair)
-	spa := modules.NewSpawner(opStatus, chanPair, outputDir, maxRoutines)
-	go req.Main()
-	go spa.Main()
+	req := modules.NewRequester(opStatus, query, providers, pages, chanPair, reporter)
+	spa := modules.NewSpawner(opStatus, chanPair, modules.SpawnerConfig{
+		OutputDir:   outputDir,
+		MaxRoutines: maxRoutines,
+		GetTimeout:  getTimeout,
+		Reporter:    reporter,
+		Manifest:    manifest,
+		Force:       force,
+		HostLimiter: modules.NewHostLimiter(globalRPS, perHostRPS),
+		HostSem:     modules.NewHostSemaphore(perHostLimit),
+		MinBytes:    minBytes,
+		MaxRetries:  maxRetries,
+	})
+	modules.RunPipeline(ctx, opStatus, req, spa)
 	logInfo.Print("Main process started.")
 
+	cancelled := false
+	retried, skipped := 0, 0
 	reply, ok := <-opStatus
 	for ok {
-		if reply.Status == modules.Success {
+		switch reply.Status {
+		case modules.Success:
 			logInfo.Print(reply.ObjType, ": Succeeded.")
-		} else {
+		case modules.Cancelled:
+			cancelled = true
+			logError.Print(reply.ObjType, ": Cancelled: ", reply.ErrorMsg)
+		case modules.Retried:
+			retried++
+			logInfo.Print(reply.ObjType, ": Retrying: ", reply.ErrorMsg)
+		case modules.Skipped:
+			skipped++
+			logInfo.Print(reply.ObjType, ": Skipped: ", reply.ErrorMsg)
+		default:
 			logError.Print(reply.ObjType, ": ", reply.ErrorMsg)
 		}
 		reply, ok = <-opStatus
 	}
+
+	if barReporter != nil {
+		barReporter.Finish()
+	}
+
+	if retried > 0 || skipped > 0 {
+		logInfo.Print("Summary: ", retried, " retried attempt(s), ", skipped, " image(s) skipped.")
+	}
+
+	if cancelled {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,95 @@
+package modules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestFileName is the name of the manifest file a Manifest persists
+// under an output directory.
+const manifestFileName = "manifest.json"
+
+// ManifestEntry records what is known about a single image a Writer has
+// saved, keyed in Manifest by the SHA-256 hex digest of its content.
+type ManifestEntry struct {
+	SourceUrl   string    `json:"source_url"`
+	PageTitle   string    `json:"page_title"`
+	Provider    string    `json:"provider"`
+	SavedPath   string    `json:"saved_path"`
+	Bytes       int64     `json:"bytes"`
+	ContentType string    `json:"content_type"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Manifest is the on-disk index of images a Writer has already saved,
+// keyed by the SHA-256 hex digest of their content. It is persisted as
+// <outputDir>/manifest.json and rewritten atomically on every update so a
+// concurrent reader never observes a partial file.
+type Manifest struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]ManifestEntry
+}
+
+// LoadManifest reads the manifest under outputDir, returning an empty one if
+// it doesn't exist yet.
+func LoadManifest(outputDir string) (*Manifest, error) {
+	m := &Manifest{path: filepath.Join(outputDir, manifestFileName), entries: map[string]ManifestEntry{}}
+
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Lookup returns the entry recorded for digest, if any.
+func (m *Manifest) Lookup(digest string) (ManifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[digest]
+	return entry, ok
+}
+
+// Put records entry under digest and atomically rewrites the manifest file.
+func (m *Manifest) Put(digest string, entry ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[digest] = entry
+	return m.save()
+}
+
+// save rewrites the manifest file via a temp file + rename so the file at
+// m.path is always either the old or the new version, never a partial one.
+func (m *Manifest) save() error {
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), manifestFileName+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
@@ -0,0 +1,106 @@
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadManifestMissingFileIsEmpty(t *testing.T) {
+	m, err := LoadManifest(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Lookup("deadbeef"); ok {
+		t.Error("Lookup on a freshly loaded, empty manifest found an entry")
+	}
+}
+
+func TestManifestPutLookupRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := ManifestEntry{
+		SourceUrl:   "http://example.com/a.png",
+		PageTitle:   "a title",
+		Provider:    "html",
+		SavedPath:   filepath.Join(dir, "a.png"),
+		Bytes:       1234,
+		ContentType: "image/png",
+		FetchedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := m.Put("digest1", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := m.Lookup("digest1")
+	if !ok {
+		t.Fatal("Lookup did not find the entry just Put")
+	}
+	if got != entry {
+		t.Errorf("Lookup returned %+v, want %+v", got, entry)
+	}
+
+	if _, ok := m.Lookup("nope"); ok {
+		t.Error("Lookup found an entry for a digest that was never Put")
+	}
+}
+
+func TestManifestPersistsAcrossLoad(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := ManifestEntry{SourceUrl: "http://example.com/b.png", SavedPath: filepath.Join(dir, "b.png")}
+	if err := m.Put("digest2", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := reloaded.Lookup("digest2")
+	if !ok {
+		t.Fatal("reloaded Manifest did not contain the entry persisted by the previous one")
+	}
+	if got != entry {
+		t.Errorf("reloaded entry = %+v, want %+v", got, entry)
+	}
+}
+
+func TestManifestSaveIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put("digest3", ManifestEntry{SourceUrl: "http://example.com/c.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != manifestFileName {
+			t.Errorf("save() left a stray file behind: %s, want only %s", e.Name(), manifestFileName)
+		}
+	}
+}
+
+func TestLoadManifestRejectsMalformedJSON(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, manifestFileName), []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(dir); err == nil {
+		t.Error("LoadManifest with malformed JSON succeeded, want an error")
+	}
+}
@@ -1,6 +1,6 @@
 /*
 Package modules consists of the following parts:
- - a function to send a query to Bing
+ - a SearchProvider interface (and built-in implementations) to query an image search backend
  - a function to spawn workers given the query result
  - a function that gets an image given a url (from a query result)
  - a function that writes content to a file
@@ -8,18 +8,24 @@ Package modules consists of the following parts:
 package modules
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type OperationStatus int
@@ -27,8 +33,42 @@ type OperationStatus int
 const (
 	Success OperationStatus = iota
 	Failure
+	// Cancelled marks a reply whose underlying operation did not run to
+	// completion because its context was cancelled or timed out, as opposed
+	// to one that failed outright.
+	Cancelled
+	// Retried marks a Getter request that hit a transient error (a network
+	// error or a 429/5xx response) and is being retried with backoff; it is
+	// informational and is always followed by another reply for the same
+	// download.
+	Retried
+	// Skipped marks a Getter response that was rejected before being handed
+	// to the Writer, because it wasn't an image or was smaller than the
+	// configured minimum.
+	Skipped
 )
 
+// ErrSkippedContentType is returned by Getter.Get when a response's
+// Content-Type header indicates it isn't an image.
+var ErrSkippedContentType = errors.New("modules: rejected: response Content-Type is not an image")
+
+// ErrSkippedTooSmall is returned by Getter.Get when a response's
+// Content-Length is smaller than the configured minimum.
+var ErrSkippedTooSmall = errors.New("modules: rejected: response is smaller than the configured minimum size")
+
+// statusForError classifies err as Cancelled when it stems from context
+// cancellation or a timeout, as Skipped when it stems from a rejected
+// response, and as Failure otherwise.
+func statusForError(err error) OperationStatus {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Cancelled
+	}
+	if errors.Is(err, ErrSkippedContentType) || errors.Is(err, ErrSkippedTooSmall) {
+		return Skipped
+	}
+	return Failure
+}
+
 const maxIndices = 100
 
 type OperationReply struct {
@@ -38,8 +78,13 @@ type OperationReply struct {
 }
 
 type ImgData struct {
-	name    string
-	content *io.ReadCloser
+	name        string
+	content     *io.ReadCloser
+	sourceUrl   string
+	title       string
+	provider    string
+	contentType string
+	fetchedAt   time.Time
 }
 
 // OuterJSON is a type to extract important information from the JSON returned by Bing;
@@ -58,6 +103,9 @@ type ResultsStream struct {
 type ResultPair struct {
 	Title    string
 	MediaUrl string
+	// Provider is the name of the SearchProvider that produced this result;
+	// Requester fills it in, it is never present in the raw JSON.
+	Provider string
 }
 
 func getPairs(jsonStr []byte) (result []ResultPair, err error) {
@@ -69,153 +117,252 @@ func getPairs(jsonStr []byte) (result []ResultPair, err error) {
 	return
 }
 
-// Requester's role is to make a request to Bing image search,
-// and sends the query result to Spawner
+// Requester's role is to query one or more SearchProviders,
+// and sends the combined query results to Spawner
 type Requester struct {
 	supervisor  chan<- *OperationReply
 	queryStr    string
-	accountKey  string
+	providers   []SearchProvider
+	pages       int
 	childWorker chan<- *ResultPair
+	reporter    Reporter
+}
+
+// NewRequester builds a Requester that issues queryStr against each of
+// providers, fetching pages pages of results from each one. Progress is
+// published to reporter; pass NoopReporter{} if it isn't needed.
+func NewRequester(supervisor chan<- *OperationReply, query string, providers []SearchProvider, pages int, childWorker chan<- *ResultPair, reporter Reporter) *Requester {
+	return &Requester{supervisor, query, providers, pages, childWorker, reporter}
 }
 
-func NewRequester(supervisor chan<- *OperationReply, query string, accKey string, childWorker chan<- *ResultPair) *Requester {
-	return &Requester{supervisor, query, accKey, childWorker}
+// rep returns r.reporter, falling back to NoopReporter for a zero-value Requester.
+func (r *Requester) rep() Reporter {
+	if r.reporter != nil {
+		return r.reporter
+	}
+	return NoopReporter{}
 }
 
 // Main method is the main method for Requester; it issues a query
-// and sends the query result to workers.
-func (r *Requester) Main() {
+// and sends the query result to workers, honoring cancellation of ctx.
+func (r *Requester) Main(ctx context.Context) {
+	name := reflect.TypeOf(*r).Name()
 	defer func() {
-		name := reflect.TypeOf(*r).Name()
 		if rec := recover(); rec != nil {
 			r.supervisor <- &OperationReply{ObjType: name, Status: Failure, ErrorMsg: rec}
-		} else {
-			r.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 		}
 	}()
 
-	results, err := r.Request()
+	results, err := r.Request(ctx)
 	if err != nil {
-		panic(err)
+		r.supervisor <- &OperationReply{ObjType: name, Status: statusForError(err), ErrorMsg: err}
+		close(r.childWorker)
+		return
 	}
+
 	for _, pair := range results {
-		r.childWorker <- &pair
+		select {
+		case r.childWorker <- &pair:
+		case <-ctx.Done():
+			r.supervisor <- &OperationReply{ObjType: name, Status: Cancelled, ErrorMsg: ctx.Err()}
+			close(r.childWorker)
+			return
+		}
 	}
 
 	close(r.childWorker)
+	r.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 }
 
-// Request method is the main method for Requester; it issues a query,
-// gets the result and returns a pair of the name and url of an image
-// possibly with an error struct
-func (r *Requester) Request() (pairs []ResultPair, err error) {
-
-	resultStream, err := r.sendQuery()
-	if err != nil {
-		return
-	}
-
-	jsonByte, err := ioutil.ReadAll(*resultStream)
-	if err != nil {
-		return
+// Request method is the main method for Requester; it queries every
+// configured SearchProvider for r.pages pages and returns the combined
+// pairs of name and url of the images found, possibly with an error struct.
+// Request stops and returns the error from the first provider/page that
+// fails, including ctx.Err() if ctx is cancelled between pages.
+func (r *Requester) Request(ctx context.Context) (pairs []ResultPair, err error) {
+	for _, provider := range r.providers {
+		for page := 0; page < r.pages; page++ {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			r.rep().QueryIssued(provider.Name(), r.queryStr, page)
+			found, pErr := provider.Search(ctx, r.queryStr, page)
+			if pErr != nil {
+				err = pErr
+				return
+			}
+			r.rep().ResultsReceived(provider.Name(), len(found))
+			for i := range found {
+				found[i].Provider = provider.Name()
+			}
+			pairs = append(pairs, found...)
+		}
 	}
-
-	pairs, err = getPairs(jsonByte)
 	return
 }
 
-// sendQuery sends a query consisting of the given string (words) to Bing Image Search.
-// The return value is the query result (string that consists of a JSON object).
-func (r *Requester) sendQuery() (result *io.ReadCloser, err error) {
-	tr := &http.Transport{
-		TLSClientConfig:    &tls.Config{},
-		DisableCompression: true,
-	}
-	client := &http.Client{Transport: tr}
-	query := url.QueryEscape("'" + r.queryStr + "'")
-	qp := strings.Join([]string{"$format=json", "Query=" + query}, "&")
-	rootUri := "https://api.datamarket.azure.com/Bing/Search/Image"
-	requestUri := rootUri + "?" + qp
-
-	request, err := r.createNewRequest(requestUri)
-	if err != nil {
-		result = nil
-		return
-	}
-
-	resp, err := client.Do(request)
-	if err != nil {
-		result = nil
-		return
-	}
-
-	return (&resp.Body), nil
+// RunPipeline starts req and spa concurrently, each in its own goroutine,
+// and closes supervisor once both have returned — which, since Spawner.Main
+// itself waits for every Getter and its Writer to finish before returning,
+// means every OperationReply that this run of the pipeline will ever send
+// has already been sent. Callers must not send on supervisor themselves,
+// and should drain it (e.g. `for reply := range supervisor`) until it's
+// closed rather than relying on any other signal that the run is done.
+func RunPipeline(ctx context.Context, supervisor chan<- *OperationReply, req *Requester, spa *Spawner) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		req.Main(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		spa.Main(ctx)
+	}()
+	go func() {
+		wg.Wait()
+		close(supervisor)
+	}()
 }
 
-// createNewRequest is a helper function for sendQuery;
-// this creates a new request given a uri and account_key.
-func (r *Requester) createNewRequest(requestUri string) (request *http.Request, err error) {
-	request, err = http.NewRequest("GET", requestUri, nil)
-	if err == nil {
-		request.SetBasicAuth(r.accountKey, r.accountKey)
-	}
-	return request, err
+// SpawnerConfig collects the knobs a Spawner is built with; it grew too
+// large for NewSpawner's argument list to stay readable as one positional
+// call.
+type SpawnerConfig struct {
+	OutputDir   string
+	MaxRoutines int
+	GetTimeout  time.Duration
+	Reporter    Reporter
+	// Manifest enables content-hash dedup mode when non-nil; Force disables
+	// the resulting skip of already-seen digests.
+	Manifest *Manifest
+	Force    bool
+	// HostLimiter and HostSem throttle and cap concurrency of Getter
+	// requests per host; both are optional (nil/zero-value means
+	// unlimited).
+	HostLimiter *HostLimiter
+	HostSem     *HostSemaphore
+	// MinBytes rejects any response whose Content-Length is known and
+	// smaller than it; zero disables the check.
+	MinBytes int64
+	// MaxRetries is the number of additional attempts Getter.Get makes
+	// after a network error or a 429/5xx response, with backoff between
+	// attempts.
+	MaxRetries int
 }
 
 // Spawner's role is to create workers and to issue operations to them.
 type Spawner struct {
 	supervisor   chan<- *OperationReply
 	targetStream <-chan *ResultPair
-	outputDir    string
-	maxRoutines  int
+	cfg          SpawnerConfig
+	// client is shared by every Getter this Spawner creates, so downloads to
+	// the same host reuse a warm connection pool instead of paying setup
+	// cost on every attempt; per-request timeouts are applied via the
+	// context passed to Getter.Get rather than Client.Timeout.
+	client *http.Client
 }
 
-func NewSpawner(supervisor chan<- *OperationReply, targets <-chan *ResultPair, outputDir string, maxRoutines int) *Spawner {
-	return &Spawner{supervisor, targets, outputDir, maxRoutines}
+// NewSpawner builds a Spawner that downloads images from targets into
+// cfg.OutputDir, per the limits and options in cfg.
+func NewSpawner(supervisor chan<- *OperationReply, targets <-chan *ResultPair, cfg SpawnerConfig) *Spawner {
+	return &Spawner{supervisor, targets, cfg, &http.Client{}}
 }
 
 // Spawner's Main function generates one Writer and many Getters.
-// The Getters asynchronously fetches images and send the content to the Writer.
-func (s *Spawner) Main() {
+// The Getters asynchronously fetches images and send the content to the
+// Writer. ctx is threaded through to every Getter and the Writer, and
+// cancelling it stops the spawn loop and lets already-running workers wind
+// down.
+func (s *Spawner) Main(ctx context.Context) {
+	name := reflect.TypeOf(*s).Name()
 	defer func() {
-		name := reflect.TypeOf(*s).Name()
 		if r := recover(); r != nil {
 			s.supervisor <- &OperationReply{ObjType: name, Status: Failure, ErrorMsg: r}
-		} else {
-			s.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 		}
 	}()
 
-	var wg sync.WaitGroup
-	wgp := &wg
+	// workersWg tracks the spawn loop below (via the initial Add(1)/Done()
+	// pair, so Wait doesn't return before any getter has even been spawned)
+	// and every Getter it starts. writerWg tracks only the Writer, and is
+	// waited on separately: the Writer keeps draining getAndWrite after the
+	// last Getter has finished, so it must not be folded into workersWg —
+	// doing so would deadlock, since the Writer doesn't stop until
+	// getAndWrite is closed below, which itself waits on workersWg.
+	var workersWg sync.WaitGroup
+	var writerWg sync.WaitGroup
 	getAndWrite := make(chan *ImgData)
-	wgp.Add(1)
+	workersWg.Add(1)
 
 	probe := make(chan bool)
 
-	writer := Writer{s.supervisor, s.outputDir, getAndWrite}
-	go writer.Main(wgp)
+	writerWg.Add(1)
+	writer := Writer{
+		supervisor: s.supervisor,
+		dir:        s.cfg.OutputDir,
+		imgBox:     getAndWrite,
+		reporter:   s.cfg.Reporter,
+		manifest:   s.cfg.Manifest,
+		force:      s.cfg.Force,
+	}
+	go writer.Main(ctx, &writerWg)
 
-	pair, ok := <-s.targetStream
 	currentRoutines := 0
 
-	for ok {
-		getter := Getter{s.supervisor, pair.MediaUrl, getAndWrite, probe}
-		wgp.Add(1)
-		go getter.Main(wgp)
-		currentRoutines++
-
-		if currentRoutines >= s.maxRoutines {
-			_ = <-probe
-			currentRoutines--
+loop:
+	for {
+		select {
+		case pair, ok := <-s.targetStream:
+			if !ok {
+				break loop
+			}
+			getter := Getter{
+				supervisor:   s.supervisor,
+				url:          pair.MediaUrl,
+				title:        pair.Title,
+				provider:     pair.Provider,
+				imgPost:      getAndWrite,
+				spawnerProbe: probe,
+				client:       s.client,
+				timeout:      s.cfg.GetTimeout,
+				reporter:     s.cfg.Reporter,
+				hostLimiter:  s.cfg.HostLimiter,
+				hostSem:      s.cfg.HostSem,
+				minBytes:     s.cfg.MinBytes,
+				maxRetries:   s.cfg.MaxRetries,
+			}
+			workersWg.Add(1)
+			go getter.Main(ctx, &workersWg)
+			currentRoutines++
+
+			if currentRoutines >= s.cfg.MaxRoutines {
+				select {
+				case <-probe:
+					currentRoutines--
+				case <-ctx.Done():
+					break loop
+				}
+			}
+		case <-ctx.Done():
+			break loop
 		}
-		pair, ok = <-s.targetStream
 	}
-	wgp.Done()
+	workersWg.Done()
 
-	wgp.Wait()
+	workersWg.Wait()
 	close(getAndWrite)
-
+	// Only once the Writer has actually drained getAndWrite and sent its own
+	// final reply do we let Main return, so a caller coordinating the
+	// lifetime of the shared supervisor channel (see RunPipeline) can tell
+	// every reply this Spawner and its Writer/Getters will ever send has
+	// already been sent.
+	writerWg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		s.supervisor <- &OperationReply{ObjType: name, Status: Cancelled, ErrorMsg: err}
+		return
+	}
+	s.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 }
 
 // Getter's role is to fetch a page (image) that is specified
@@ -224,42 +371,268 @@ func (s *Spawner) Main() {
 type Getter struct {
 	supervisor   chan<- *OperationReply
 	url          string
+	title        string
+	provider     string
 	imgPost      chan<- *ImgData
 	spawnerProbe chan<- bool
+	// client is shared across every attempt of every Getter spawned by the
+	// same Spawner, so connections to a host are reused rather than
+	// re-established on every request; a nil client (e.g. in tests) falls
+	// back to http.DefaultClient.
+	client       *http.Client
+	timeout      time.Duration
+	reporter     Reporter
+	// hostLimiter and hostSem throttle and cap concurrency of the request
+	// this Getter issues, keyed by the request's host; both are optional.
+	hostLimiter *HostLimiter
+	hostSem     *HostSemaphore
+	// minBytes rejects a response whose Content-Length is known and smaller
+	// than it; zero disables the check.
+	minBytes int64
+	// maxRetries is the number of additional attempts Get makes after a
+	// network error or a 429/5xx response.
+	maxRetries int
+}
+
+// rep returns g.reporter, falling back to NoopReporter for a zero-value Getter.
+func (g *Getter) rep() Reporter {
+	if g.reporter != nil {
+		return g.reporter
+	}
+	return NoopReporter{}
+}
+
+// httpClient returns g.client, falling back to http.DefaultClient for a
+// zero-value Getter.
+func (g *Getter) httpClient() *http.Client {
+	if g.client != nil {
+		return g.client
+	}
+	return http.DefaultClient
 }
 
 // Getter's Main function gets an image and sends a pointer to its content to the Writer.
-func (g *Getter) Main(wg *sync.WaitGroup) {
+func (g *Getter) Main(ctx context.Context, wg *sync.WaitGroup) {
+	name := reflect.TypeOf(*g).Name()
 	defer func() {
-		name := reflect.TypeOf(*g).Name()
 		if r := recover(); r != nil {
 			g.supervisor <- &OperationReply{ObjType: name, Status: Failure, ErrorMsg: r}
-		} else {
-			g.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 		}
 		wg.Done()
 		g.spawnerProbe <- true
 	}()
 
-	content, err := g.Get()
-
+	content, contentType, err := g.Get(ctx)
 	if err != nil {
-		panic(err)
+		g.rep().Error(filepath.Base(g.url), err)
+		g.supervisor <- &OperationReply{ObjType: name, Status: statusForError(err), ErrorMsg: err}
+		return
 	}
 
 	fileName := filepath.Base(g.url)
-	g.imgPost <- &ImgData{fileName, content}
+	imgData := &ImgData{
+		name:        fileName,
+		content:     content,
+		sourceUrl:   g.url,
+		title:       g.title,
+		provider:    g.provider,
+		contentType: contentType,
+		fetchedAt:   time.Now().UTC(),
+	}
+	select {
+	case g.imgPost <- imgData:
+		g.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
+	case <-ctx.Done():
+		g.supervisor <- &OperationReply{ObjType: name, Status: Cancelled, ErrorMsg: ctx.Err()}
+	}
+}
+
+// progressWriter reports every chunk written through it as download progress
+// for id; it never itself errors.
+type progressWriter struct {
+	id       string
+	reporter Reporter
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	p.reporter.DownloadProgress(p.id, int64(len(b)))
+	return len(b), nil
 }
 
-// Get gets resource specified by the given url and returns a pointer to
-// io.ReadCloser that spits out the content.
-func (g *Getter) Get() (*io.ReadCloser, error) {
-	resp, err := http.Get(g.url)
+// Get gets the resource specified by the given url and returns a pointer to
+// an io.ReadCloser that spits out the content (along with its Content-Type),
+// publishing byte-level progress to g.reporter as it is read. Get reuses
+// g.client (shared across every Getter spawned by the same Spawner, so
+// connections to a host are kept warm) rather than building one per call.
+// Each attempt is bound to ctx and, if g.timeout is positive, to a
+// derived context that aborts the attempt after g.timeout.
+//
+// Get acquires a g.hostSem slot once, holding it across every attempt, and
+// waits on g.hostLimiter before every attempt, retrying up to g.maxRetries
+// times (with exponential backoff and jitter, honoring a
+// Retry-After header) on a network error or a 429/5xx response, reporting
+// each retry as Retried on g.supervisor. A response whose Content-Type isn't
+// an image or whose Content-Length is below g.minBytes is rejected with
+// ErrSkippedContentType or ErrSkippedTooSmall without being retried.
+func (g *Getter) Get(ctx context.Context) (*io.ReadCloser, string, error) {
+	name := reflect.TypeOf(*g).Name()
+	host := hostOf(g.url)
+
+	release, err := g.hostSem.Acquire(ctx, host)
 	if err != nil {
-		return nil, err
-	} else {
-		return (&resp.Body), err
+		return nil, "", err
 	}
+	released := false
+	releaseOnce := func() {
+		if !released {
+			released = true
+			release()
+		}
+	}
+	defer releaseOnce()
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if err := g.hostLimiter.Wait(ctx, host); err != nil {
+			return nil, "", err
+		}
+
+		attemptCtx := ctx
+		cancel := func() {}
+		if g.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, g.timeout)
+		}
+
+		request, err := http.NewRequestWithContext(attemptCtx, "GET", g.url, nil)
+		if err != nil {
+			cancel()
+			return nil, "", err
+		}
+
+		resp, err := g.httpClient().Do(request)
+		if err != nil {
+			cancel()
+			lastErr = err
+			if attempt >= g.maxRetries {
+				return nil, "", lastErr
+			}
+			g.supervisor <- &OperationReply{ObjType: name, Status: Retried, ErrorMsg: lastErr}
+			if err := sleepBackoff(ctx, attempt, 0); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			cancel()
+			lastErr = fmt.Errorf("modules: got status %d fetching %s", resp.StatusCode, g.url)
+			if attempt >= g.maxRetries {
+				return nil, "", lastErr
+			}
+			g.supervisor <- &OperationReply{ObjType: name, Status: Retried, ErrorMsg: lastErr}
+			if err := sleepBackoff(ctx, attempt, retryAfter); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			cancel()
+			return nil, "", fmt.Errorf("modules: got status %d fetching %s", resp.StatusCode, g.url)
+		}
+
+		contentType := resp.Header.Get("Content-Type")
+		if contentType != "" && !strings.HasPrefix(contentType, "image/") {
+			resp.Body.Close()
+			cancel()
+			return nil, "", ErrSkippedContentType
+		}
+		if g.minBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength < g.minBytes {
+			resp.Body.Close()
+			cancel()
+			return nil, "", ErrSkippedTooSmall
+		}
+
+		id := filepath.Base(g.url)
+		g.rep().DownloadStarted(id, resp.ContentLength)
+		// Ownership of release passes to the returned countingReadCloser,
+		// which calls it on Close; suppress the deferred releaseOnce so the
+		// slot isn't freed until the body is closed.
+		released = true
+		var rc io.ReadCloser = &countingReadCloser{
+			Reader:  io.TeeReader(resp.Body, progressWriter{id: id, reporter: g.rep()}),
+			closer:  resp.Body,
+			cancel:  cancel,
+			release: release,
+		}
+		return &rc, contentType, nil
+	}
+}
+
+// hostOf returns the host component of rawUrl, or "" if it can't be parsed.
+func hostOf(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// parseRetryAfter parses the delay-in-seconds form of a Retry-After header,
+// returning 0 if header is empty or isn't in that form.
+func parseRetryAfter(header string) time.Duration {
+	secs, err := strconv.Atoi(header)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// sleepBackoff waits out the backoff for attempt (or retryAfter, if given)
+// or returns ctx.Err() if ctx is cancelled first.
+func sleepBackoff(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	select {
+	case <-time.After(backoffDelay(attempt, retryAfter)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoffDelay computes an exponential backoff with jitter for the given
+// (zero-based) attempt, deferring to retryAfter when the server gave one.
+func backoffDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	base := (250 * time.Millisecond) << uint(attempt)
+	return base + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+// countingReadCloser adapts a Reader (typically wrapping a TeeReader) and a
+// separate Closer into a single io.ReadCloser. If release is set, it is
+// called once, after closer, when Close is called (typically to free a
+// HostSemaphore slot held for the lifetime of the download); likewise for
+// cancel, which releases the per-attempt context.WithTimeout created for
+// this download, if any, when Close is called.
+type countingReadCloser struct {
+	io.Reader
+	closer  io.Closer
+	cancel  context.CancelFunc
+	release func()
+}
+
+func (c *countingReadCloser) Close() error {
+	err := c.closer.Close()
+	if c.release != nil {
+		c.release()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return err
 }
 
 // Writer's role is to write the image fetched by Getter to the file
@@ -269,30 +642,72 @@ type Writer struct {
 	supervisor chan<- *OperationReply
 	dir        string
 	imgBox     <-chan *ImgData
+	reporter   Reporter
+	// manifest enables content-hash dedup mode when non-nil: every written
+	// image's SHA-256 digest is looked up (and recorded) there instead of
+	// writing duplicate content twice.
+	manifest *Manifest
+	// force disables the skip that dedup mode would otherwise apply to a
+	// digest already present in manifest.
+	force bool
+}
+
+// rep returns w.reporter, falling back to NoopReporter for a zero-value Writer.
+func (w *Writer) rep() Reporter {
+	if w.reporter != nil {
+		return w.reporter
+	}
+	return NoopReporter{}
 }
 
-func (w *Writer) Main(wg *sync.WaitGroup) {
+// Main drains imgBox, writing each image to disk, until it is closed or ctx
+// is cancelled. wg.Done is called once Main's own final reply has been sent,
+// so a caller wanting to close w.supervisor only after every writer and
+// getter fed by it has finished can simply wait on wg first (see
+// Spawner.Main and RunPipeline); Main itself never closes w.supervisor.
+func (w *Writer) Main(ctx context.Context, wg *sync.WaitGroup) {
+	name := reflect.TypeOf(*w).Name()
 	defer func() {
-		name := reflect.TypeOf(*w).Name()
 		if r := recover(); r != nil {
 			w.supervisor <- &OperationReply{ObjType: name, Status: Failure, ErrorMsg: r}
-		} else {
-			w.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 		}
-		close(w.supervisor)
+		wg.Done()
 	}()
-	imgData, ok := <-w.imgBox
-	for ok {
-		w.Write(imgData.name, imgData.content)
-		imgData, ok = <-w.imgBox
+
+loop:
+	for {
+		select {
+		case imgData, ok := <-w.imgBox:
+			if !ok {
+				break loop
+			}
+			if err := w.Write(imgData); err != nil {
+				w.rep().Error(imgData.name, err)
+			}
+		case <-ctx.Done():
+			break loop
+		}
 	}
+
+	if err := ctx.Err(); err != nil {
+		w.supervisor <- &OperationReply{ObjType: name, Status: Cancelled, ErrorMsg: err}
+		return
+	}
+	w.supervisor <- &OperationReply{ObjType: name, Status: Success, ErrorMsg: nil}
 }
 
-// Write writes the content of ReadCloser rc to file specified by
-// `w.dir + "/" + imgName`. If the file already exists, it appends
-// some number to the end of the filename (before the file extension.)
-func (w *Writer) Write(imgName string, rc *io.ReadCloser) error {
-	candidatePath := filepath.Join(w.dir, imgName)
+// Write streams the content of img to a file specified by
+// `w.dir + "/" + img.name`. If the file already exists, it appends some
+// number to the end of the filename (before the file extension.) In dedup
+// mode (w.manifest != nil), it delegates to writeDedup instead.
+func (w *Writer) Write(img *ImgData) error {
+	defer (*img.content).Close()
+
+	if w.manifest != nil {
+		return w.writeDedup(img)
+	}
+
+	candidatePath := filepath.Join(w.dir, img.name)
 	validPath, err := validFilenameMaker(candidatePath)
 	if err != nil {
 		return err
@@ -302,17 +717,76 @@ func (w *Writer) Write(imgName string, rc *io.ReadCloser) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, *img.content); err != nil {
+		return err
+	}
+
+	w.rep().DownloadFinished(img.name)
+	w.rep().FileWritten(img.name, validPath)
+	return nil
+}
+
+// writeDedup streams img to a temporary file while computing its SHA-256
+// digest. If the digest is already present in the manifest and force isn't
+// set, validPath is hard-linked to the previously saved copy instead of
+// writing the same bytes out again, and the temp file is discarded. If that
+// previously saved copy no longer exists (or otherwise can't be linked to),
+// writeDedup reports the failure through the reporter and falls back to
+// writing the temp file out and refreshing the manifest entry, the same as
+// for a new digest, rather than silently dropping the image.
+func (w *Writer) writeDedup(img *ImgData) error {
+	candidatePath := filepath.Join(w.dir, img.name)
+	validPath, err := validFilenameMaker(candidatePath)
+	if err != nil {
+		return err
+	}
 
-	img, err := ioutil.ReadAll(*rc)
+	tmp, err := ioutil.TempFile(w.dir, "."+filepath.Base(img.name)+".tmp-*")
 	if err != nil {
 		return err
 	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
 
-	_, err = file.Write(img)
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), *img.content)
 	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	w.rep().DownloadFinished(img.name)
+
+	if existing, ok := w.manifest.Lookup(digest); ok && !w.force {
+		if err := os.Link(existing.SavedPath, validPath); err == nil {
+			w.rep().FileWritten(img.name, validPath)
+			return nil
+		}
+		w.rep().Error(img.name, fmt.Errorf("modules: could not hard-link duplicate of %s, writing a new copy instead", existing.SavedPath))
+	}
+
+	if err := os.Rename(tmpPath, validPath); err != nil {
+		return err
+	}
+
+	if err := w.manifest.Put(digest, ManifestEntry{
+		SourceUrl:   img.sourceUrl,
+		PageTitle:   img.title,
+		Provider:    img.provider,
+		SavedPath:   validPath,
+		Bytes:       written,
+		ContentType: img.contentType,
+		FetchedAt:   img.fetchedAt,
+	}); err != nil {
 		return err
 	}
 
+	w.rep().FileWritten(img.name, validPath)
 	return nil
 }
 
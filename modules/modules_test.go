@@ -1,10 +1,16 @@
 package modules
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -28,18 +34,19 @@ func TestGetPairs(t *testing.T) {
 	}
 }
 
-func TestSendQuery(t *testing.T) {
+func TestBingProviderSearch(t *testing.T) {
 	if testing.Short() {
-		t.Skip("skipping sendQuery test in short mode.")
+		t.Skip("skipping bingProvider.Search test in short mode.")
 	}
-	req := Requester{queryStr: "cat", accountKey: myKey}
-	qResult, err := req.sendQuery()
+	provider, err := NewSearchProvider("bing", ProviderConfig{Auth: AuthConfig{BasicUser: myKey, BasicPass: myKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := provider.Search(context.Background(), "cat", 0)
 	if err != nil {
 		t.Error(err)
 	} else {
-		jsonStr, _ := ioutil.ReadAll(*qResult)
-		(*qResult).Close()
-		t.Log(string(jsonStr))
+		t.Log(results)
 	}
 }
 
@@ -49,7 +56,7 @@ func TestGet(t *testing.T) {
 	}
 	yahooImg := "http://k.yimg.jp/images/top/sp2/cmn/logo-ns-130528.png"
 	g := Getter{url: yahooImg}
-	result, err := g.Get()
+	result, _, err := g.Get(context.Background())
 
 	if err != nil {
 		t.Error(err)
@@ -93,3 +100,158 @@ func TestValidFilenameMaker(t *testing.T) {
 		os.Remove(path.Join(tmpdir, fmt.Sprintf("foo_%d.png", i)))
 	}
 }
+
+// newTestImgData builds an ImgData whose content is the given string, for
+// use with Writer.Write/writeDedup.
+func newTestImgData(name, content string) *ImgData {
+	rc := io.NopCloser(strings.NewReader(content))
+	return &ImgData{name: name, content: &rc, sourceUrl: "http://example.com/" + name}
+}
+
+func TestWriteDedupFirstWriteRecordsManifestEntry(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Writer{dir: dir, manifest: manifest}
+
+	if err := w.Write(newTestImgData("a.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("file content = %q, want %q", data, "hello")
+	}
+
+	digest := sha256Hex(t, "hello")
+	entry, ok := manifest.Lookup(digest)
+	if !ok {
+		t.Fatal("manifest has no entry for the written content's digest")
+	}
+	if entry.SavedPath != filepath.Join(dir, "a.png") {
+		t.Errorf("entry.SavedPath = %q, want %q", entry.SavedPath, filepath.Join(dir, "a.png"))
+	}
+}
+
+func TestWriteDedupHardlinksADuplicate(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Writer{dir: dir, manifest: manifest}
+
+	if err := w.Write(newTestImgData("a.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(newTestImgData("b.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	aInfo, err := os.Stat(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(filepath.Join(dir, "b.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(aInfo, bInfo) {
+		t.Error("b.png is not hard-linked to a.png despite identical content")
+	}
+}
+
+func TestWriteDedupForceDisablesSkip(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Writer{dir: dir, manifest: manifest, force: true}
+
+	if err := w.Write(newTestImgData("a.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(newTestImgData("b.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	aInfo, err := os.Stat(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(filepath.Join(dir, "b.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(aInfo, bInfo) {
+		t.Error("b.png is hard-linked to a.png even though force was set")
+	}
+}
+
+// errorCapturingReporter embeds NoopReporter and records every Error call,
+// for tests that need to assert a failure was at least reported somewhere.
+type errorCapturingReporter struct {
+	NoopReporter
+	errors []error
+}
+
+func (r *errorCapturingReporter) Error(id string, err error) {
+	r.errors = append(r.errors, err)
+}
+
+// TestWriteDedupHardlinkFailureFallsBackToNormalWrite covers writeDedup's
+// behavior when os.Link fails for a duplicate digest (e.g. the previously
+// recorded SavedPath no longer exists): rather than silently dropping the
+// new download, it reports the failure through the reporter and falls back
+// to writing the content out and refreshing the manifest entry, same as for
+// a digest seen for the first time.
+func TestWriteDedupHardlinkFailureFallsBackToNormalWrite(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := &errorCapturingReporter{}
+	w := Writer{dir: dir, manifest: manifest, reporter: reporter}
+
+	digest := sha256Hex(t, "hello")
+	if err := manifest.Put(digest, ManifestEntry{SavedPath: filepath.Join(dir, "missing.png")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Write(newTestImgData("b.png", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "b.png"))
+	if err != nil {
+		t.Fatalf("b.png was not written after the failed hard link: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("b.png content = %q, want %q", data, "hello")
+	}
+
+	entry, ok := manifest.Lookup(digest)
+	if !ok {
+		t.Fatal("manifest has no entry for the digest after the fallback write")
+	}
+	if entry.SavedPath != filepath.Join(dir, "b.png") {
+		t.Errorf("entry.SavedPath = %q, want %q", entry.SavedPath, filepath.Join(dir, "b.png"))
+	}
+
+	if len(reporter.errors) == 0 {
+		t.Error("the failed hard link was not reported through the Reporter")
+	}
+}
+
+func sha256Hex(t *testing.T, content string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,100 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// zeroResultProvider is a SearchProvider that always returns no results, to
+// reproduce the "Requester and Spawner/Writer wind down with nothing to do"
+// race that RunPipeline exists to close off.
+type zeroResultProvider struct{}
+
+func (zeroResultProvider) Name() string { return "zero" }
+
+func (zeroResultProvider) Search(ctx context.Context, query string, page int) ([]ResultPair, error) {
+	return nil, nil
+}
+
+// TestRunPipelineZeroResultsDoesNotPanic exercises Requester.Main,
+// Spawner.Main, and Writer.Main together the way main does, with a provider
+// that returns nothing: Spawner/Writer then have no Getter to wait for and
+// can finish almost immediately. Before RunPipeline, Writer unilaterally
+// closed the shared supervisor channel once it wound down, racing
+// Requester's own post-close(childWorker) success send; when Writer won the
+// race, that send panicked with "send on closed channel", and the recover in
+// Requester.Main's own defer tried to send again on the now-closed channel,
+// panicking a second time, unrecovered, and crashing the process. Run many
+// iterations concurrently since the race is timing-dependent.
+func TestRunPipelineZeroResultsDoesNotPanic(t *testing.T) {
+	// The race this guards against needs genuine concurrency to surface;
+	// bump GOMAXPROCS (restored after the test) since a constrained CI
+	// runner may otherwise default to 1 and never interleave the relevant
+	// goroutines.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	const iterations = 2000
+
+	var wg sync.WaitGroup
+	for i := 0; i < iterations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			opStatus := make(chan *OperationReply)
+			chanPair := make(chan *ResultPair)
+
+			req := NewRequester(opStatus, "cat", []SearchProvider{zeroResultProvider{}}, 1, chanPair, nil)
+			spa := NewSpawner(opStatus, chanPair, SpawnerConfig{
+				OutputDir:   t.TempDir(),
+				MaxRoutines: 4,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			RunPipeline(ctx, opStatus, req, spa)
+
+			for range opStatus {
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestRunPipelineClosesSupervisorAfterBothFinish checks the happy path:
+// every reply sent by a single-image run is observed before supervisor is
+// closed, and it is in fact closed (the loop below terminates on its own).
+func TestRunPipelineClosesSupervisorAfterBothFinish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	opStatus := make(chan *OperationReply)
+	chanPair := make(chan *ResultPair, 1)
+	chanPair <- &ResultPair{Title: "t", MediaUrl: server.URL + "/a.png", Provider: "test"}
+	close(chanPair)
+
+	req := NewRequester(opStatus, "cat", nil, 0, make(chan *ResultPair), nil)
+	spa := NewSpawner(opStatus, chanPair, SpawnerConfig{OutputDir: t.TempDir(), MaxRoutines: 4})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	RunPipeline(ctx, opStatus, req, spa)
+
+	var statuses []OperationStatus
+	for reply := range opStatus {
+		statuses = append(statuses, reply.Status)
+	}
+
+	if len(statuses) == 0 {
+		t.Fatal("no replies observed before supervisor closed")
+	}
+}
@@ -0,0 +1,248 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthConfig carries the credentials a SearchProvider needs to authenticate
+// its outgoing requests. At most one kind of credential (API key, bearer
+// token, or basic-auth user/password pair) is expected to be set; if several
+// are, Apply uses the first one present in that order.
+type AuthConfig struct {
+	APIKey      string // sent in the Ocp-Apim-Subscription-Key header
+	BearerToken string
+	BasicUser   string
+	BasicPass   string
+}
+
+// Apply attaches the configured credentials to req.
+func (a AuthConfig) Apply(req *http.Request) {
+	switch {
+	case a.APIKey != "":
+		req.Header.Set("Ocp-Apim-Subscription-Key", a.APIKey)
+	case a.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	case a.BasicUser != "" || a.BasicPass != "":
+		req.SetBasicAuth(a.BasicUser, a.BasicPass)
+	}
+}
+
+// SearchProvider abstracts a single image-search backend. Search returns the
+// results found on the given (zero-based) page of the given query, aborting
+// early if ctx is cancelled.
+type SearchProvider interface {
+	Name() string
+	Search(ctx context.Context, query string, page int) ([]ResultPair, error)
+}
+
+// ProviderConfig configures a SearchProvider built through the registry. Not
+// every field is meaningful to every provider: Auth and QueryTimeout are
+// used by all of them, URLTemplate only by the providers that are driven by
+// one (opensearch and html).
+type ProviderConfig struct {
+	Auth         AuthConfig
+	URLTemplate  string
+	QueryTimeout time.Duration
+}
+
+// ProviderFactory builds a SearchProvider from a ProviderConfig.
+type ProviderFactory func(ProviderConfig) (SearchProvider, error)
+
+var providerRegistry = map[string]ProviderFactory{}
+
+// RegisterProvider makes a SearchProvider implementation available under
+// name for use with NewSearchProvider. It is meant to be called from the
+// init function of the file that defines the provider.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providerRegistry[name] = factory
+}
+
+// NewSearchProvider looks up the provider registered under name and
+// constructs it with cfg.
+func NewSearchProvider(name string, cfg ProviderConfig) (SearchProvider, error) {
+	factory, ok := providerRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("modules: no SearchProvider registered with name %q", name)
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterProvider("bing", newBingProvider)
+	RegisterProvider("opensearch", newOpenSearchProvider)
+	RegisterProvider("html", newHTMLProvider)
+}
+
+// pageSize is the number of results per page: bing requests it via $top, and
+// the {skip} placeholder of a URL template is expanded to page*pageSize.
+const pageSize = 50
+
+// bingProvider talks to the (now retired) Bing Image Search API on Azure
+// Datamarket. It is kept around to preserve existing behavior for callers
+// who still have a Datamarket account key; new setups should prefer the
+// opensearch or html providers instead.
+type bingProvider struct {
+	auth   AuthConfig
+	client *http.Client
+}
+
+func newBingProvider(cfg ProviderConfig) (SearchProvider, error) {
+	return &bingProvider{auth: cfg.Auth, client: &http.Client{Timeout: cfg.QueryTimeout}}, nil
+}
+
+func (b *bingProvider) Name() string { return "bing" }
+
+// Search issues a single paginated query against Bing Image Search using
+// Datamarket's $skip/$top paging.
+func (b *bingProvider) Search(ctx context.Context, query string, page int) ([]ResultPair, error) {
+	escaped := url.QueryEscape("'" + query + "'")
+	qp := strings.Join([]string{
+		"$format=json",
+		"Query=" + escaped,
+		fmt.Sprintf("$skip=%d", page*pageSize),
+		fmt.Sprintf("$top=%d", pageSize),
+	}, "&")
+	requestUri := "https://api.datamarket.azure.com/Bing/Search/Image?" + qp
+
+	request, err := http.NewRequest("GET", requestUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	b.auth.Apply(request)
+
+	resp, err := b.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jsonByte, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return getPairs(jsonByte)
+}
+
+// openSearchResponse is the JSON shape expected from a generic search
+// endpoint driven by openSearchProvider.
+type openSearchResponse struct {
+	Results []struct {
+		Title string `json:"title"`
+		Url   string `json:"url"`
+	} `json:"results"`
+}
+
+// openSearchProvider drives a generic JSON search endpoint described by a URL
+// template containing the placeholders {query} and {skip}.
+type openSearchProvider struct {
+	auth        AuthConfig
+	client      *http.Client
+	urlTemplate string
+}
+
+func newOpenSearchProvider(cfg ProviderConfig) (SearchProvider, error) {
+	if cfg.URLTemplate == "" {
+		return nil, fmt.Errorf("modules: opensearch provider requires a URL template")
+	}
+	return &openSearchProvider{auth: cfg.Auth, client: &http.Client{Timeout: cfg.QueryTimeout}, urlTemplate: cfg.URLTemplate}, nil
+}
+
+func (o *openSearchProvider) Name() string { return "opensearch" }
+
+func (o *openSearchProvider) Search(ctx context.Context, query string, page int) ([]ResultPair, error) {
+	body, err := fetchTemplatedUrl(ctx, o.client, o.urlTemplate, o.auth, query, page)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed openSearchResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+
+	pairs := make([]ResultPair, len(parsed.Results))
+	for i, r := range parsed.Results {
+		pairs[i] = ResultPair{Title: r.Title, MediaUrl: r.Url}
+	}
+	return pairs, nil
+}
+
+// imgTagPattern pulls the src and (optional) alt attribute out of an <img>
+// tag; it is deliberately forgiving about attribute order since we're
+// scraping pages we don't control.
+var imgTagPattern = regexp.MustCompile(`(?is)<img\b[^>]*\bsrc="([^"]+)"[^>]*>`)
+var altAttrPattern = regexp.MustCompile(`(?is)\balt="([^"]*)"`)
+
+// htmlProvider scrapes <img> tags out of a rendered results page for search
+// engines that don't expose a JSON API. Like openSearchProvider, it is
+// driven by a URL template containing {query} and {skip}.
+type htmlProvider struct {
+	auth        AuthConfig
+	client      *http.Client
+	urlTemplate string
+}
+
+func newHTMLProvider(cfg ProviderConfig) (SearchProvider, error) {
+	if cfg.URLTemplate == "" {
+		return nil, fmt.Errorf("modules: html provider requires a URL template")
+	}
+	return &htmlProvider{auth: cfg.Auth, client: &http.Client{Timeout: cfg.QueryTimeout}, urlTemplate: cfg.URLTemplate}, nil
+}
+
+func (h *htmlProvider) Name() string { return "html" }
+
+func (h *htmlProvider) Search(ctx context.Context, query string, page int) ([]ResultPair, error) {
+	body, err := fetchTemplatedUrl(ctx, h.client, h.urlTemplate, h.auth, query, page)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := imgTagPattern.FindAllStringSubmatch(string(body), -1)
+	pairs := make([]ResultPair, 0, len(tags))
+	for _, tag := range tags {
+		title := ""
+		if alt := altAttrPattern.FindStringSubmatch(tag[0]); alt != nil {
+			title = alt[1]
+		}
+		pairs = append(pairs, ResultPair{MediaUrl: tag[1], Title: title})
+	}
+	return pairs, nil
+}
+
+// fetchTemplatedUrl expands a URL template shared by the opensearch and html
+// providers and returns the response body.
+func fetchTemplatedUrl(ctx context.Context, client *http.Client, urlTemplate string, auth AuthConfig, query string, page int) ([]byte, error) {
+	requestUri := strings.NewReplacer(
+		"{query}", url.QueryEscape(query),
+		"{skip}", strconv.Itoa(page*pageSize),
+	).Replace(urlTemplate)
+
+	request, err := http.NewRequest("GET", requestUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	auth.Apply(request)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("modules: got status %d fetching %s", resp.StatusCode, requestUri)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,172 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchTemplatedUrl(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.RequestURI()
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name     string
+		query    string
+		page     int
+		template string
+		wantPath string
+	}{
+		{
+			name:     "substitutes query and skip",
+			query:    "cute cat",
+			page:     2,
+			template: server.URL + "/search?q={query}&skip={skip}",
+			wantPath: "/search?q=cute+cat&skip=100",
+		},
+		{
+			name:     "first page skips zero",
+			query:    "dog",
+			page:     0,
+			template: server.URL + "/search?q={query}&skip={skip}",
+			wantPath: "/search?q=dog&skip=0",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := fetchTemplatedUrl(context.Background(), server.Client(), c.template, AuthConfig{}, c.query, c.page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotPath != c.wantPath {
+				t.Errorf("got path %q, want %q", gotPath, c.wantPath)
+			}
+		})
+	}
+}
+
+func TestFetchTemplatedUrlRejectsNonOKStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := fetchTemplatedUrl(context.Background(), server.Client(), server.URL+"/{query}/{skip}", AuthConfig{}, "cat", 0)
+	if err == nil {
+		t.Fatal("expected an error for a 404 response, got nil")
+	}
+}
+
+func TestHTMLProviderSearchPropagatesFetchError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	provider, err := NewSearchProvider("html", ProviderConfig{URLTemplate: server.URL + "/?q={query}&skip={skip}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Search(context.Background(), "cat", 0); err == nil {
+		t.Error("expected Search to surface the 500 response as an error instead of treating it as zero results")
+	}
+}
+
+func TestHTMLProviderSearch(t *testing.T) {
+	page := `
+<html><body>
+<img src="http://example.com/a.png" alt="first image">
+<div><img alt="second image" src="http://example.com/b.png" data-lazy="true"></div>
+<img src="http://example.com/c.png">
+</body></html>`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	provider, err := NewSearchProvider("html", ProviderConfig{URLTemplate: server.URL + "/?q={query}&skip={skip}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := provider.Search(context.Background(), "cat", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ResultPair{
+		{MediaUrl: "http://example.com/a.png", Title: "first image"},
+		{MediaUrl: "http://example.com/b.png", Title: "second image"},
+		{MediaUrl: "http://example.com/c.png", Title: ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d result(s), want %d: %v", len(results), len(want), results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+}
+
+func TestNewSearchProviderUnknownName(t *testing.T) {
+	if _, err := NewSearchProvider("nope", ProviderConfig{}); err == nil {
+		t.Error("expected an error for an unregistered provider name")
+	}
+}
+
+func TestNewOpenSearchProviderRequiresURLTemplate(t *testing.T) {
+	if _, err := NewSearchProvider("opensearch", ProviderConfig{}); err == nil {
+		t.Error("expected an error when URLTemplate is empty")
+	}
+}
+
+func TestNewHTMLProviderRequiresURLTemplate(t *testing.T) {
+	if _, err := NewSearchProvider("html", ProviderConfig{}); err == nil {
+		t.Error("expected an error when URLTemplate is empty")
+	}
+}
+
+func TestAuthConfigApply(t *testing.T) {
+	cases := []struct {
+		name   string
+		auth   AuthConfig
+		header string
+		want   string
+	}{
+		{name: "api key", auth: AuthConfig{APIKey: "k"}, header: "Ocp-Apim-Subscription-Key", want: "k"},
+		{name: "bearer token", auth: AuthConfig{BearerToken: "t"}, header: "Authorization", want: "Bearer t"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.auth.Apply(req)
+			if got := req.Header.Get(c.header); got != c.want {
+				t.Errorf("header %s = %q, want %q", c.header, got, c.want)
+			}
+		})
+	}
+
+	t.Run("basic auth", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AuthConfig{BasicUser: "u", BasicPass: "p"}.Apply(req)
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "u" || pass != "p" {
+			t.Errorf("BasicAuth() = %q, %q, %v, want %q, %q, true", user, pass, ok, "u", "p")
+		}
+	})
+}
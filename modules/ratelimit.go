@@ -0,0 +1,112 @@
+package modules
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// burstFor picks a reasonable token-bucket burst size for a requests-per-
+// second budget: allow at least one request even for fractional RPS.
+func burstFor(rps float64) int {
+	if b := int(rps); b > 1 {
+		return b
+	}
+	return 1
+}
+
+// HostLimiter throttles outgoing requests with a token-bucket limiter:
+// one shared across every host, and optionally a separate, tighter one per
+// host. A zero RPS for either scope means "unlimited" for that scope.
+type HostLimiter struct {
+	global  *rate.Limiter
+	perHost rate.Limit
+	burst   int
+
+	mu    sync.Mutex
+	hosts map[string]*rate.Limiter
+}
+
+// NewHostLimiter builds a HostLimiter from a global and a per-host RPS.
+func NewHostLimiter(globalRPS, perHostRPS float64) *HostLimiter {
+	hl := &HostLimiter{hosts: map[string]*rate.Limiter{}}
+	if globalRPS > 0 {
+		hl.global = rate.NewLimiter(rate.Limit(globalRPS), burstFor(globalRPS))
+	}
+	if perHostRPS > 0 {
+		hl.perHost = rate.Limit(perHostRPS)
+		hl.burst = burstFor(perHostRPS)
+	}
+	return hl
+}
+
+// Wait blocks until both the global and host's budget allow one more
+// request, or ctx is cancelled.
+func (hl *HostLimiter) Wait(ctx context.Context, host string) error {
+	if hl == nil {
+		return nil
+	}
+	if hl.global != nil {
+		if err := hl.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if hl.perHost <= 0 {
+		return nil
+	}
+	return hl.limiterFor(host).Wait(ctx)
+}
+
+func (hl *HostLimiter) limiterFor(host string) *rate.Limiter {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	limiter, ok := hl.hosts[host]
+	if !ok {
+		limiter = rate.NewLimiter(hl.perHost, hl.burst)
+		hl.hosts[host] = limiter
+	}
+	return limiter
+}
+
+// HostSemaphore caps how many requests may be in flight to any single host
+// at once.
+type HostSemaphore struct {
+	limit int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// NewHostSemaphore builds a HostSemaphore allowing limit concurrent
+// in-flight requests per host. limit <= 0 means unlimited.
+func NewHostSemaphore(limit int) *HostSemaphore {
+	return &HostSemaphore{limit: limit, sems: map[string]chan struct{}{}}
+}
+
+// Acquire blocks until a slot for host is free or ctx is cancelled. It
+// always returns a release func, which is a no-op when limiting is
+// disabled or acquisition failed.
+func (hs *HostSemaphore) Acquire(ctx context.Context, host string) (release func(), err error) {
+	if hs == nil || hs.limit <= 0 {
+		return func() {}, nil
+	}
+	sem := hs.semFor(host)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return func() {}, ctx.Err()
+	}
+}
+
+func (hs *HostSemaphore) semFor(host string) chan struct{} {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	sem, ok := hs.sems[host]
+	if !ok {
+		sem = make(chan struct{}, hs.limit)
+		hs.sems[host] = sem
+	}
+	return sem
+}
@@ -0,0 +1,188 @@
+package modules
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBurstFor(t *testing.T) {
+	cases := []struct {
+		rps  float64
+		want int
+	}{
+		{rps: 0, want: 1},
+		{rps: 0.5, want: 1},
+		{rps: 1, want: 1},
+		{rps: 1.9, want: 1},
+		{rps: 2, want: 2},
+		{rps: 10.7, want: 10},
+	}
+	for _, c := range cases {
+		if got := burstFor(c.rps); got != c.want {
+			t.Errorf("burstFor(%v) = %d, want %d", c.rps, got, c.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "empty", header: "", want: 0},
+		{name: "seconds", header: "5", want: 5 * time.Second},
+		{name: "zero", header: "0", want: 0},
+		{name: "negative is ignored", header: "-1", want: 0},
+		{name: "non-numeric is ignored", header: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parseRetryAfter(c.header); got != c.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	t.Run("honors retryAfter over the computed backoff", func(t *testing.T) {
+		if got := backoffDelay(5, 3*time.Second); got != 3*time.Second {
+			t.Errorf("backoffDelay(5, 3s) = %v, want 3s", got)
+		}
+	})
+
+	t.Run("doubles and stays within its jitter bound per attempt", func(t *testing.T) {
+		for attempt := 0; attempt < 5; attempt++ {
+			base := (250 * time.Millisecond) << uint(attempt)
+			d := backoffDelay(attempt, 0)
+			if d < base || d > 2*base {
+				t.Errorf("backoffDelay(%d, 0) = %v, want in [%v, %v]", attempt, d, base, 2*base)
+			}
+		}
+	})
+}
+
+func TestHostLimiterNilIsUnlimited(t *testing.T) {
+	var hl *HostLimiter
+	if err := hl.Wait(context.Background(), "example.com"); err != nil {
+		t.Errorf("nil *HostLimiter.Wait() = %v, want nil", err)
+	}
+}
+
+func TestHostLimiterZeroRPSIsUnlimited(t *testing.T) {
+	hl := NewHostLimiter(0, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		if err := hl.Wait(ctx, "example.com"); err != nil {
+			t.Fatalf("Wait() call %d = %v, want nil", i, err)
+		}
+	}
+}
+
+func TestHostLimiterPerHostIsIndependent(t *testing.T) {
+	// 1 RPS with burst 1: a limiter shared by both hosts would throttle the
+	// second Wait past the deadline.
+	hl := NewHostLimiter(0, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	if err := hl.Wait(ctx, "a.example.com"); err != nil {
+		t.Fatalf("Wait(a) = %v, want nil", err)
+	}
+	if err := hl.Wait(ctx, "b.example.com"); err != nil {
+		t.Fatalf("Wait(b) = %v, want nil", err)
+	}
+}
+
+func TestHostLimiterGlobalBoundsAcrossHosts(t *testing.T) {
+	hl := NewHostLimiter(1, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	if err := hl.Wait(context.Background(), "a.example.com"); err != nil {
+		t.Fatalf("first Wait() = %v, want nil", err)
+	}
+	// The global bucket (1 RPS, burst 1) is now empty, so a second request to
+	// a different host should still be throttled by the shared limiter.
+	if err := hl.Wait(ctx, "b.example.com"); err == nil {
+		t.Error("second Wait() on a different host succeeded within the deadline, want it throttled by the global limiter")
+	}
+}
+
+func TestHostSemaphoreNilIsUnlimited(t *testing.T) {
+	var hs *HostSemaphore
+	release, err := hs.Acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("nil *HostSemaphore.Acquire() = %v, want nil", err)
+	}
+	release()
+}
+
+func TestHostSemaphoreZeroLimitIsUnlimited(t *testing.T) {
+	hs := NewHostSemaphore(0)
+	release, err := hs.Acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Acquire() = %v, want nil", err)
+	}
+	release()
+}
+
+func TestHostSemaphoreCapsConcurrencyPerHost(t *testing.T) {
+	hs := NewHostSemaphore(1)
+
+	release1, err := hs.Acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("first Acquire() = %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := hs.Acquire(ctx, "example.com"); err == nil {
+		t.Error("second Acquire() on the same host succeeded while the first slot was held, want it blocked")
+	}
+
+	release1()
+	if release2, err := hs.Acquire(context.Background(), "example.com"); err != nil {
+		t.Fatalf("Acquire() after release = %v, want nil", err)
+	} else {
+		release2()
+	}
+}
+
+func TestHostSemaphoreHostsAreIndependent(t *testing.T) {
+	hs := NewHostSemaphore(1)
+
+	releaseA, err := hs.Acquire(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatalf("Acquire(a) = %v, want nil", err)
+	}
+	defer releaseA()
+
+	releaseB, err := hs.Acquire(context.Background(), "b.example.com")
+	if err != nil {
+		t.Fatalf("Acquire(b) = %v, want nil", err)
+	}
+	defer releaseB()
+}
+
+func TestHostSemaphoreConcurrentAcquireRelease(t *testing.T) {
+	hs := NewHostSemaphore(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := hs.Acquire(context.Background(), "example.com")
+			if err != nil {
+				t.Errorf("Acquire() = %v, want nil", err)
+				return
+			}
+			release()
+		}()
+	}
+	wg.Wait()
+}
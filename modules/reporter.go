@@ -0,0 +1,190 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Reporter receives progress events from the Requester, Getter, and Writer
+// as a query runs. Implementations render those events however is
+// appropriate (structured log lines, a terminal progress bar, ...). id
+// identifies the image a download/write event is about; callers use the
+// base name of the image's URL.
+type Reporter interface {
+	QueryIssued(provider, query string, page int)
+	ResultsReceived(provider string, count int)
+	DownloadStarted(id string, total int64)
+	DownloadProgress(id string, delta int64)
+	DownloadFinished(id string)
+	FileWritten(id, path string)
+	Error(id string, err error)
+}
+
+// NoopReporter discards every event. It is the Reporter used whenever a
+// Requester, Getter, or Writer is constructed without one explicitly.
+type NoopReporter struct{}
+
+func (NoopReporter) QueryIssued(provider, query string, page int) {}
+func (NoopReporter) ResultsReceived(provider string, count int)   {}
+func (NoopReporter) DownloadStarted(id string, total int64)       {}
+func (NoopReporter) DownloadProgress(id string, delta int64)      {}
+func (NoopReporter) DownloadFinished(id string)                   {}
+func (NoopReporter) FileWritten(id, path string)                  {}
+func (NoopReporter) Error(id string, err error)                   {}
+
+// progressDetail mirrors Docker's JSONMessage.ProgressDetail.
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// jsonEvent is the shape of a single line emitted by JSONReporter.
+type jsonEvent struct {
+	Status         string          `json:"status"`
+	Id             string          `json:"id,omitempty"`
+	ProgressDetail *progressDetail `json:"progressDetail,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// JSONReporter writes one JSON object per line to Out for every event, in
+// the same spirit as `docker pull`'s JSON progress stream.
+type JSONReporter struct {
+	Out io.Writer
+
+	mu      sync.Mutex
+	current map[string]int64
+	total   map[string]int64
+}
+
+// NewJSONReporter builds a JSONReporter that writes to out.
+func NewJSONReporter(out io.Writer) *JSONReporter {
+	return &JSONReporter{Out: out, current: map[string]int64{}, total: map[string]int64{}}
+}
+
+func (j *JSONReporter) emit(ev jsonEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	json.NewEncoder(j.Out).Encode(ev)
+}
+
+func (j *JSONReporter) QueryIssued(provider, query string, page int) {
+	j.emit(jsonEvent{Status: fmt.Sprintf("Querying %s for %q (page %d)", provider, query, page)})
+}
+
+func (j *JSONReporter) ResultsReceived(provider string, count int) {
+	j.emit(jsonEvent{Status: fmt.Sprintf("%s returned %d result(s)", provider, count)})
+}
+
+func (j *JSONReporter) DownloadStarted(id string, total int64) {
+	j.mu.Lock()
+	j.current[id] = 0
+	j.total[id] = total
+	j.mu.Unlock()
+	j.emit(jsonEvent{Status: "Downloading", Id: id, ProgressDetail: &progressDetail{Total: total}})
+}
+
+func (j *JSONReporter) DownloadProgress(id string, delta int64) {
+	j.mu.Lock()
+	j.current[id] += delta
+	current, total := j.current[id], j.total[id]
+	j.mu.Unlock()
+	j.emit(jsonEvent{Status: "Downloading", Id: id, ProgressDetail: &progressDetail{Current: current, Total: total}})
+}
+
+func (j *JSONReporter) DownloadFinished(id string) {
+	j.emit(jsonEvent{Status: "Download complete", Id: id})
+}
+
+func (j *JSONReporter) FileWritten(id, path string) {
+	j.emit(jsonEvent{Status: "Saved as " + path, Id: id})
+}
+
+func (j *JSONReporter) Error(id string, err error) {
+	j.emit(jsonEvent{Status: "Error", Id: id, Error: err.Error()})
+}
+
+// BarReporter renders one aggregate pb.ProgressBar for the whole batch
+// (incremented once per finished download), plus an optional per-file bar
+// for each in-flight download.
+type BarReporter struct {
+	overall *pb.ProgressBar
+	pool    *pb.Pool
+	perFile bool
+
+	mu   sync.Mutex
+	bars map[string]*pb.ProgressBar
+}
+
+// NewBarReporter starts an aggregate progress bar on stderr. When perFile is
+// true, every in-flight download also gets its own byte-progress bar.
+func NewBarReporter(perFile bool) (*BarReporter, error) {
+	overall := pb.New(0)
+	overall.SetTemplateString(`{{counters . }} images {{bar . }} {{percent . }}`)
+
+	br := &BarReporter{overall: overall, perFile: perFile, bars: map[string]*pb.ProgressBar{}}
+	if perFile {
+		pool, err := pb.StartPool(overall)
+		if err != nil {
+			return nil, err
+		}
+		br.pool = pool
+	} else {
+		overall.Start()
+	}
+	return br, nil
+}
+
+func (b *BarReporter) QueryIssued(provider, query string, page int) {}
+
+func (b *BarReporter) ResultsReceived(provider string, count int) {
+	b.overall.SetTotal(b.overall.Total() + int64(count))
+}
+
+func (b *BarReporter) DownloadStarted(id string, total int64) {
+	if !b.perFile {
+		return
+	}
+	bar := pb.New64(total).Set(pb.Bytes, true).Set("prefix", id+" ")
+	b.mu.Lock()
+	b.bars[id] = bar
+	b.mu.Unlock()
+	b.pool.Add(bar)
+	bar.Start()
+}
+
+func (b *BarReporter) DownloadProgress(id string, delta int64) {
+	b.mu.Lock()
+	bar := b.bars[id]
+	b.mu.Unlock()
+	if bar != nil {
+		bar.Add64(delta)
+	}
+}
+
+func (b *BarReporter) DownloadFinished(id string) {
+	b.overall.Increment()
+
+	b.mu.Lock()
+	bar := b.bars[id]
+	delete(b.bars, id)
+	b.mu.Unlock()
+	if bar != nil {
+		bar.Finish()
+	}
+}
+
+func (b *BarReporter) FileWritten(id, path string) {}
+func (b *BarReporter) Error(id string, err error)  {}
+
+// Finish stops the underlying bar(s); call it once the batch is done.
+func (b *BarReporter) Finish() {
+	if b.pool != nil {
+		b.pool.Stop()
+		return
+	}
+	b.overall.Finish()
+}